@@ -1,13 +1,23 @@
 package main
 
 import (
-	"net/http"
-	"log"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"time"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
 	"sort"
-	"context"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // Simplifies json encoding/decoding
@@ -32,104 +42,549 @@ func setToArray(set map[int]struct{}) []int {
 	return result
 }
 
+// Timings breaks down where time went during a single NumbersGetterHttp.get call, as reported by
+// net/http/httptrace. Zero means the phase wasn't observed (e.g. a reused connection has no
+// Connect/TLSHandshake phase).
+type Timings struct {
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	FirstByte    time.Duration // from request start to the first response byte
+}
+
+// Result bundles what a NumbersGetter call produced: the parsed numbers (nil if error), the HTTP
+// status code (-1 if error), and timing information for diagnosing slow upstreams.
+type Result struct {
+	Numbers []int
+	Status  int
+	Timings Timings
+}
+
 // Purpose: to abstract fetching numbers from url.
-// Returns: numbers slice (nil if error),
-//          HTTP status code (-1 if error)
-//          Error (nil if no error)
 type NumbersGetter interface {
-	get(ctx context.Context, url string) ([]int, int, error)
+	get(ctx context.Context, url string) (Result, error)
+}
+
+// NumbersGetterHttpCfg configures the *http.Transport backing a NumbersGetterHttp, mirroring the
+// tuning knobs of net/http.Transport so callers can bound connection reuse and per-host fan-out.
+type NumbersGetterHttpCfg struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	MaxResponseBytes      int64 // caps how much of a response body get() will read
+}
+
+func defaultNumbersGetterHttpCfg() NumbersGetterHttpCfg {
+	return NumbersGetterHttpCfg{
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		MaxConnsPerHost:       0, // unbounded, left to MaxIdleConnsPerHost in practice
+		IdleConnTimeout:       90 * time.Second,
+		DialTimeout:           5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxResponseBytes:      10 * 1024 * 1024,
+	}
+}
+
+func newHttpClient(cfg NumbersGetterHttpCfg) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:          cfg.MaxIdleConns,
+			MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+			MaxConnsPerHost:       cfg.MaxConnsPerHost,
+			IdleConnTimeout:       cfg.IdleConnTimeout,
+			ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+			DialContext:           (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext,
+		},
+	}
+}
+
+var (
+	defaultHttpClientOnce sync.Once
+	defaultHttpClient     *http.Client
+)
+
+// defaultNumbersGetterHttpClient lazily builds the shared client used by the zero value of
+// NumbersGetterHttp, so callers who don't need custom tuning don't have to call the constructor.
+func defaultNumbersGetterHttpClient() *http.Client {
+	defaultHttpClientOnce.Do(func() {
+		defaultHttpClient = newHttpClient(defaultNumbersGetterHttpCfg())
+	})
+	return defaultHttpClient
 }
 
 // Http implementation of `NumbersGetter`.
 // `get` blocks current routine until it fetches data from endpoint, or error occurs, or context cancelled.
-type NumbersGetterHttp struct {}
+// The zero value uses a shared client with sensible defaults; use NewNumbersGetterHttp to tune it.
+type NumbersGetterHttp struct {
+	client           *http.Client
+	maxResponseBytes int64
+}
 
-func (NumbersGetterHttp) get(ctx context.Context, url string) ([]int, int, error) {
+// NewNumbersGetterHttp builds a NumbersGetterHttp backed by a transport tuned per cfg, so
+// connections are pooled and reused instead of each `get` paying a fresh dial/handshake.
+func NewNumbersGetterHttp(cfg NumbersGetterHttpCfg) NumbersGetterHttp {
+	return NumbersGetterHttp{client: newHttpClient(cfg), maxResponseBytes: cfg.MaxResponseBytes}
+}
+
+func (g NumbersGetterHttp) httpClient() *http.Client {
+	if g.client != nil {
+		return g.client
+	}
+	return defaultNumbersGetterHttpClient()
+}
+
+func (g NumbersGetterHttp) maxBytes() int64 {
+	if g.maxResponseBytes != 0 {
+		return g.maxResponseBytes
+	}
+	return defaultNumbersGetterHttpCfg().MaxResponseBytes
+}
+
+func (g NumbersGetterHttp) get(ctx context.Context, url string) (Result, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, -1, err
+		return Result{Status: -1}, err
 	}
-	client := http.Client{}
-	res, err := client.Do(req.WithContext(ctx))
+	req.Header.Set("Accept-Encoding", "gzip")
+	start := time.Now()
+	timings := &Timings{}
+	ctx = httptrace.WithClientTrace(ctx, httpTraceTimings(start, timings))
+	res, err := g.httpClient().Do(req.WithContext(ctx))
 	if res != nil {
 		defer res.Body.Close()
 	}
 	if err != nil {
-		return nil, -1, err
+		return Result{Status: -1, Timings: *timings}, err
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, res.StatusCode, nil
+		return Result{Status: res.StatusCode, Timings: *timings}, nil
 	}
-	body, err := ioutil.ReadAll(res.Body)
+	body := io.Reader(res.Body)
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return Result{Status: -1, Timings: *timings}, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	numbers, err := decodeNumbersStream(io.LimitReader(body, g.maxBytes()))
 	if err != nil {
-		return nil, -1, err
+		return Result{Status: -1, Timings: *timings}, err
 	}
-	numbers := Numbers{}
-	err = json.Unmarshal(body, &numbers)
+	return Result{Numbers: numbers, Status: res.StatusCode, Timings: *timings}, nil
+}
+
+// httpTraceTimings builds a httptrace.ClientTrace that fills in timings as the request
+// progresses, measured relative to start.
+func httpTraceTimings(start time.Time, timings *Timings) *httptrace.ClientTrace {
+	var dnsStart, connectStart, tlsStart time.Time
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			if !dnsStart.IsZero() {
+				timings.DNS = time.Since(dnsStart)
+			}
+		},
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			if !connectStart.IsZero() {
+				timings.Connect = time.Since(connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			if !tlsStart.IsZero() {
+				timings.TLSHandshake = time.Since(tlsStart)
+			}
+		},
+		GotFirstResponseByte: func() {
+			timings.FirstByte = time.Since(start)
+		},
+	}
+}
+
+// decodeNumbersStream reads a `{"numbers": [...], ...}` document element by element instead of
+// buffering the whole body, so a malformed or oversized response fails as soon as the bad token
+// (or the read limit) is hit rather than after reading everything.
+func decodeNumbersStream(r io.Reader) ([]int, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	numbers := make([]int, 0, 16)
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := keyTok.(string)
+		if key != "numbers" {
+			var ignored interface{}
+			if err := dec.Decode(&ignored); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if tok == nil { // "numbers": null
+			continue
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("numbers: expected %q, got %v", '[', tok)
+		}
+		for dec.More() {
+			var n int
+			if err := dec.Decode(&n); err != nil {
+				return nil, err
+			}
+			numbers = append(numbers, n)
+		}
+		if _, err := dec.Token(); err != nil { // closing ']'
+			return nil, err
+		}
+	}
+	return numbers, nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
 	if err != nil {
-		return nil, -1, err
+		return err
 	}
-	return numbers.Numbers, res.StatusCode, nil
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("numbers: expected %q, got %v", want, tok)
+	}
+	return nil
+}
+
+// NumbersGetterRetryCfg configures NumbersGetterRetry's backoff.
+type NumbersGetterRetryCfg struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      bool
+}
+
+// NumbersGetterRetry wraps a NumbersGetter and retries on network errors, 5xx responses, and a
+// transport-level context.DeadlineExceeded, using exponential backoff with optional jitter. It
+// never retries once the caller's own context is done, since a retry couldn't succeed in time anyway.
+type NumbersGetterRetry struct {
+	g   NumbersGetter
+	cfg NumbersGetterRetryCfg
+}
+
+func NewNumbersGetterRetry(g NumbersGetter, cfg NumbersGetterRetryCfg) NumbersGetterRetry {
+	return NumbersGetterRetry{g: g, cfg: cfg}
+}
+
+func (r NumbersGetterRetry) get(ctx context.Context, url string) (Result, error) {
+	var result Result
+	var err error
+	for attempt := 1; attempt <= r.cfg.MaxAttempts; attempt++ {
+		result, err = r.g.get(ctx, url)
+		retryable := (err != nil && ctx.Err() == nil) || result.Status >= 500
+		if !retryable || attempt == r.cfg.MaxAttempts {
+			return result, err
+		}
+		select {
+		case <-time.After(retryDelay(r.cfg, attempt)):
+		case <-ctx.Done():
+			return result, err
+		}
+	}
+	return result, err
 }
 
-// Retrieves numbers from channel `c`. Blocks current routine until gets `expected` amount of results or context cancelled.
-// Stores collected data in a `result` set. Returns sorted array representation of the set.
-func collectNumbers(ctx context.Context, expected int, c <-chan []int) []int {
+// retryDelay computes delay = min(MaxDelay, BaseDelay * 2^(attempt-1)), optionally sampled
+// uniformly from [delay/2, delay] when Jitter is set.
+func retryDelay(cfg NumbersGetterRetryCfg, attempt int) time.Duration {
+	delay := cfg.MaxDelay
+	if shift := uint(attempt - 1); shift < 32 {
+		if scaled := cfg.BaseDelay * time.Duration(int64(1)<<shift); scaled > 0 && scaled < cfg.MaxDelay {
+			delay = scaled
+		}
+	}
+	if cfg.Jitter {
+		half := delay / 2
+		delay = half + time.Duration(rand.Int63n(int64(delay-half+1)))
+	}
+	return delay
+}
+
+// inflight is a get(ctx, url) call shared by every caller that asked for the same url while it
+// was still running.
+type inflight struct {
+	done   chan struct{}
+	result Result
+	err    error
+}
+
+// NumbersGetterCoalescing wraps a NumbersGetter and deduplicates concurrent `get` calls for the
+// same url: if one is already outstanding, later callers wait on its result instead of issuing a
+// second network call. Useful for the recursive "/numbers?u=/numbers?..." case, where the same
+// upstream url can otherwise be requested many times at once.
+type NumbersGetterCoalescing struct {
+	g        NumbersGetter
+	mu       sync.Mutex
+	inFlight map[string]*inflight
+}
+
+func NewNumbersGetterCoalescing(g NumbersGetter) *NumbersGetterCoalescing {
+	return &NumbersGetterCoalescing{g: g, inFlight: make(map[string]*inflight)}
+}
+
+func (c *NumbersGetterCoalescing) get(ctx context.Context, url string) (Result, error) {
+	c.mu.Lock()
+	if f, ok := c.inFlight[url]; ok {
+		c.mu.Unlock()
+		return c.wait(ctx, f)
+	}
+	f := &inflight{done: make(chan struct{})}
+	c.inFlight[url] = f
+	c.mu.Unlock()
+
+	// The upstream fetch must outlive any single caller's context, since other callers may
+	// still be waiting on it, and it must run on its own goroutine so that the caller which
+	// triggered it is, like every other caller, still subject to its own ctx in wait() below.
+	go func() {
+		f.result, f.err = c.g.get(context.Background(), url)
+		c.mu.Lock()
+		delete(c.inFlight, url)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	return c.wait(ctx, f)
+}
+
+func (c *NumbersGetterCoalescing) wait(ctx context.Context, f *inflight) (Result, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return Result{Status: -1}, ctx.Err()
+	}
+}
+
+// urlResult pairs a NumbersGetter.get result with the url it came from, so callers fanning results
+// back in (collectNumbers) can still attribute timings and status to a specific upstream.
+type urlResult struct {
+	url string
+	Result
+	err error
+}
+
+// Retrieves results from channel `c`. Blocks current routine until gets `expected` amount of
+// results or context cancelled. Stores collected numbers in a set, returned sorted, alongside the
+// raw per-url results (for timing/status logging).
+func collectNumbers(ctx context.Context, expected int, c <-chan urlResult) ([]int, []urlResult) {
 	result := make(map[int]struct{})
+	var results []urlResult
 	for expected > 0 {
 		select {
-		case numbers := <-c:
-			log.Printf("Got numbers: %v\n", numbers)
+		case ur := <-c:
+			log.Printf("Got numbers: %v\n", ur.Numbers)
 			expected -= 1
-			setAdd(result, numbers...)
+			setAdd(result, ur.Numbers...)
+			results = append(results, ur)
 		case <-ctx.Done():
 			log.Printf("Unhandled urls: %d\n", expected)
 			expected = 0
 		}
 	}
-	return setToArray(result)
+	return setToArray(result), results
 }
 
 // Fetches numbers, pass to channel (to be processed by `collectNumbers`), log errors
-func fetchNumbers(ctx context.Context, g NumbersGetter, url string, c chan []int) {
-	var result []int
-	if numbers, status, err := g.get(ctx, url); err != nil {
+func fetchNumbers(ctx context.Context, g NumbersGetter, url string, c chan urlResult) {
+	result, err := g.get(ctx, url)
+	if err != nil {
 		log.Println(err)
-	} else if status != http.StatusOK {
-		log.Printf("%s responded with %d", url, status)
-	} else {
-		result = numbers
+	} else if result.Status != http.StatusOK {
+		log.Printf("%s responded with %d", url, result.Status)
+	}
+	select {
+	case <-ctx.Done():
+	case c <- urlResult{url: url, Result: result, err: err}: // pass result even if error occured (let `collectNumbers` decrement it's `expected`)
+	}
+}
+
+// errPoolCanceled is returned by NumbersFetchPool.submit when the context is cancelled
+// before the job could be handed to a worker.
+var errPoolCanceled = errors.New("numbers: pool submission canceled")
+
+// NumbersFetchPoolCfg configures a NumbersFetchPool.
+type NumbersFetchPoolCfg struct {
+	MaxWorkers int // upper bound on concurrent outbound fetches
+	QueueDepth int // how many submitted jobs may wait for a free worker
+}
+
+const (
+	defaultMaxWorkers = 50
+	defaultQueueDepth = 100
+)
+
+// numbersFetchPoolCfgFromEnv builds a NumbersFetchPoolCfg from NUMBERS_POOL_MAX_WORKERS and
+// NUMBERS_POOL_QUEUE_DEPTH, falling back to defaults when unset or invalid.
+func numbersFetchPoolCfgFromEnv() NumbersFetchPoolCfg {
+	cfg := NumbersFetchPoolCfg{MaxWorkers: defaultMaxWorkers, QueueDepth: defaultQueueDepth}
+	if v, err := strconv.Atoi(os.Getenv("NUMBERS_POOL_MAX_WORKERS")); err == nil {
+		cfg.MaxWorkers = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("NUMBERS_POOL_QUEUE_DEPTH")); err == nil {
+		cfg.QueueDepth = v
+	}
+	return cfg
+}
+
+// fetchJob is a single unit of work submitted to a NumbersFetchPool.
+type fetchJob struct {
+	ctx    context.Context
+	g      NumbersGetter
+	url    string
+	result chan urlResult
+}
+
+// NumbersFetchPool bounds the number of `fetchNumbers` calls in flight at once, so a process
+// serving many /numbers requests never opens more than MaxWorkers concurrent outbound requests.
+type NumbersFetchPool struct {
+	jobs chan fetchJob
+}
+
+// NewNumbersFetchPool starts MaxWorkers workers pulling from a QueueDepth-buffered job queue.
+func NewNumbersFetchPool(cfg NumbersFetchPoolCfg) *NumbersFetchPool {
+	p := &NumbersFetchPool{jobs: make(chan fetchJob, cfg.QueueDepth)}
+	for i := 0; i < cfg.MaxWorkers; i++ {
+		go p.worker()
 	}
+	return p
+}
+
+func (p *NumbersFetchPool) worker() {
+	for job := range p.jobs {
+		fetchNumbers(job.ctx, job.g, job.url, job.result)
+	}
+}
+
+// submit hands a fetch job to a free worker. Blocks until a worker (or queue slot) is available
+// or ctx is cancelled, in which case it returns errPoolCanceled without enqueueing the job.
+func (p *NumbersFetchPool) submit(ctx context.Context, g NumbersGetter, url string, c chan urlResult) error {
 	select {
+	case p.jobs <- fetchJob{ctx: ctx, g: g, url: url, result: c}:
+		return nil
 	case <-ctx.Done():
-	case c <- result: // pass result even if error occured (let `collectNumbers` decrement it's `expected`)
+		return errPoolCanceled
+	}
+}
+
+// Config bundles the knobs `makeNumbersHandler` needs beyond the NumbersGetter itself.
+type Config struct {
+	Pool *NumbersFetchPool
+}
+
+// requestTiming is the per-upstream entry in the structured log line emitted once per /numbers request.
+type requestTiming struct {
+	URL     string  `json:"url"`
+	Status  int     `json:"status"`
+	Timings Timings `json:"timings"`
+}
+
+// requestLog is the structured JSON log line emitted once per /numbers request, letting operators
+// see which upstream was slow without grepping per-url log lines.
+type requestLog struct {
+	TookMs int64           `json:"took_ms"`
+	Urls   []requestTiming `json:"urls"`
+}
+
+// requestLogEntry carries what logRequestTimings needs to build one request's log line, queued
+// up for the background logger goroutine.
+type requestLogEntry struct {
+	start   time.Time
+	results []urlResult
+}
+
+var (
+	requestLogCh   = make(chan requestLogEntry, 1024)
+	requestLogOnce sync.Once
+)
+
+// startRequestLogger launches the single goroutine that marshals and emits the structured
+// per-request log line, so every handler invocation only has to do a non-blocking channel send
+// instead of paying its own JSON-marshal cost on the hot path.
+func startRequestLogger() {
+	requestLogOnce.Do(func() {
+		go func() {
+			for entry := range requestLogCh {
+				timings := make([]requestTiming, len(entry.results))
+				for i, r := range entry.results {
+					timings[i] = requestTiming{URL: r.url, Status: r.Status, Timings: r.Timings}
+				}
+				logLine, _ := json.Marshal(requestLog{TookMs: time.Now().Sub(entry.start).Milliseconds(), Urls: timings})
+				log.Printf("%s", logLine)
+			}
+		}()
+	})
+}
+
+// logRequestTimings hands off a request's timings to the background logger, dropping them
+// instead of blocking the response if the logger is falling behind.
+func logRequestTimings(start time.Time, results []urlResult) {
+	startRequestLogger()
+	select {
+	case requestLogCh <- requestLogEntry{start: start, results: results}:
+	default:
 	}
 }
 
 // Constructs handler for /numbers request
 // Handler creates and configures context in order to cancel all sub-requests which are timed out and
 // when client closes connection.
-func makeNumbersHandler(g NumbersGetter) func(http.ResponseWriter, *http.Request) {
+func makeNumbersHandler(g NumbersGetter, cfg Config) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		q := r.URL.Query();
+		q := r.URL.Query()
 		urls := q["u"]
-		c := make(chan []int)
-		ctx, _ := context.WithTimeout(r.Context(), 500 * time.Millisecond)
+		// Buffered so a worker can always hand back its result without waiting for
+		// collectNumbers to start reading, which lets submission below stay synchronous
+		// (submit only blocks on pool backpressure, not on this channel) instead of spawning
+		// one goroutine per url.
+		c := make(chan urlResult, len(urls))
+		ctx, _ := context.WithTimeout(r.Context(), 500*time.Millisecond)
 		for _, url := range urls {
-			go fetchNumbers(ctx, g, url, c)
+			if err := cfg.Pool.submit(ctx, g, url, c); err != nil {
+				log.Printf("%s: %s", url, err)
+			}
 		}
-		numbers := collectNumbers(ctx, len(urls), c)
-		data, _ := json.Marshal(Numbers{Numbers:numbers})
+		numbers, results := collectNumbers(ctx, len(urls), c)
+		data, _ := json.Marshal(Numbers{Numbers: numbers})
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(data)
-		log.Printf("Processing took %v", time.Now().Sub(start))
+		logRequestTimings(start, results)
+	}
+}
+
+func defaultNumbersGetterRetryCfg() NumbersGetterRetryCfg {
+	return NumbersGetterRetryCfg{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Jitter:      true,
 	}
 }
 
 func makeHttpNumbersHandler() func(http.ResponseWriter, *http.Request) {
-	return makeNumbersHandler(NumbersGetterHttp{})
+	cfg := Config{Pool: NewNumbersFetchPool(numbersFetchPoolCfgFromEnv())}
+	g := NewNumbersGetterCoalescing(NewNumbersGetterRetry(NumbersGetterHttp{}, defaultNumbersGetterRetryCfg()))
+	return makeNumbersHandler(g, cfg)
 }
 
 func main() {
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -59,7 +64,7 @@ func numbers_get(t *testing.T, url string, expected_status int, expected_numbers
 	g := NumbersGetterHttp{}
 	// rough, 600 = 500 + routines overhead + transport overhead. Everything is in a single process.
 	ctx, _ := context.WithTimeout(context.Background(), 600*time.Millisecond)
-	result, status, err := g.get(ctx, url)
+	res, err := g.get(ctx, url)
 	if ctx.Err() != nil {
 		t.Errorf("Request failed: %s", ctx.Err())
 		return
@@ -68,12 +73,12 @@ func numbers_get(t *testing.T, url string, expected_status int, expected_numbers
 		t.Error(err)
 		return
 	}
-	if status != expected_status {
-		t.Errorf("Got status %d, expected %d (%s)", status, expected_status, url)
+	if res.Status != expected_status {
+		t.Errorf("Got status %d, expected %d (%s)", res.Status, expected_status, url)
 		return
 	}
-	if expected_status != -1 && !numbers_cmp(result, expected_numbers) {
-		t.Errorf("Got numbers %v, expected %v (%s)", result, expected_numbers, url)
+	if expected_status != -1 && !numbers_cmp(res.Numbers, expected_numbers) {
+		t.Errorf("Got numbers %v, expected %v (%s)", res.Numbers, expected_numbers, url)
 		return
 	}
 }
@@ -129,13 +134,13 @@ type NumbersGetterStub struct {
 	Config map[string]NumbersGetterStubCfg
 }
 
-func (g NumbersGetterStub) get(ctx context.Context, url string) ([]int, int, error) {
+func (g NumbersGetterStub) get(ctx context.Context, url string) (Result, error) {
 	n, ok := g.Config[url]
 	if ok {
 		time.Sleep(n.Timeout)
-		return n.Numbers, 200, nil
+		return Result{Numbers: n.Numbers, Status: 200}, nil
 	} else {
-		return nil, 404, nil
+		return Result{Status: 404}, nil
 	}
 }
 
@@ -167,21 +172,21 @@ func TestCollectNumbers(t *testing.T) {
 		Input:  [][]int{[]int{9, 1}, []int{1}, []int{5, 1, 42}},
 		Result: []int{1, 5, 9, 42},
 	}}
-	channel := make(chan []int, 10)
+	channel := make(chan urlResult, 10)
 	for _, c := range cases {
 		for _, i := range c.Input {
-			channel <- i
+			channel <- urlResult{Result: Result{Numbers: i, Status: 200}}
 		}
-		r := collectNumbers(context.Background(), len(c.Input), channel)
+		r, _ := collectNumbers(context.Background(), len(c.Input), channel)
 		if !numbers_cmp(r, c.Result) {
 			t.Errorf("collect %v, got %v, expected %v", c.Input, r, c.Result)
 		}
 	}
 
-	channel <- []int{1, 2}
-	channel <- []int{0, 0}
+	channel <- urlResult{Result: Result{Numbers: []int{1, 2}, Status: 200}}
+	channel <- urlResult{Result: Result{Numbers: []int{0, 0}, Status: 200}}
 	ctx, _ := context.WithTimeout(context.Background(), 100*time.Millisecond)
-	result := collectNumbers(ctx, 999, channel)
+	result, _ := collectNumbers(ctx, 999, channel)
 	if !numbers_cmp(result, []int{0, 1, 2}) {
 		t.Errorf("collect %v, got %v, expected %v", [][]int{[]int{1, 2}, []int{0, 0}}, result, []int{0, 1, 2})
 	}
@@ -212,7 +217,8 @@ func TestBasic(t *testing.T) {
 		{Url: "/numbers?u=/test1&u=/test2", Numbers: []int{1, 2, 3, 4, 5, 6}, Status: 200},
 		{Url: "/numbers?u=/test3&u=/test4&u=/test5&u=/test6", Numbers: []int{1, 2, 11, 12, 101, 102}, Status: 200},
 	}
-	handler := http.HandlerFunc(makeNumbersHandler(s))
+	cfg := Config{Pool: NewNumbersFetchPool(NumbersFetchPoolCfg{MaxWorkers: 4096, QueueDepth: 4096})}
+	handler := http.HandlerFunc(makeNumbersHandler(s, cfg))
 	for _, test := range testCases {
 		numbers_rr(t, test.Url, handler, test.Status, test.Numbers)
 	}
@@ -251,7 +257,8 @@ func TestConcurent(t *testing.T) {
 		{Url: "/numbers?u=/test1&u=/test2", Numbers: []int{1, 2, 3, 4, 5, 6}, Status: 200},
 		{Url: "/numbers?u=/test3&u=/test4&u=/test5&u=/test6", Numbers: []int{1, 2, 11, 12, 101, 102}, Status: 200},
 	}
-	handler := http.HandlerFunc(makeNumbersHandler(s))
+	cfg := Config{Pool: NewNumbersFetchPool(NumbersFetchPoolCfg{MaxWorkers: 4096, QueueDepth: 4096})}
+	handler := http.HandlerFunc(makeNumbersHandler(s, cfg))
 	loops := 500
 	var wg sync.WaitGroup
 	for i := 0; i < loops; i++ {
@@ -271,6 +278,362 @@ func TestConcurent(t *testing.T) {
 	wg.Wait()
 }
 
+// numbersGetterCounting wraps a NumbersGetter and tracks how many `get` calls are in flight at
+// once, so tests can assert an upper bound on concurrency instead of inferring it indirectly.
+type numbersGetterCounting struct {
+	NumbersGetter
+	inFlight int32
+	peak     int32
+}
+
+func (g *numbersGetterCounting) get(ctx context.Context, url string) (Result, error) {
+	n := atomic.AddInt32(&g.inFlight, 1)
+	for {
+		peak := atomic.LoadInt32(&g.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&g.peak, peak, n) {
+			break
+		}
+	}
+	defer atomic.AddInt32(&g.inFlight, -1)
+	return g.NumbersGetter.get(ctx, url)
+}
+
+// Same 500-loop load as TestConcurent, submitted straight to a NumbersFetchPool, asserting that
+// the number of `get` calls in flight at once never exceeds MaxWorkers, no matter how many jobs
+// are submitted, and that submitting the jobs (mirroring makeNumbersHandler, which calls submit
+// synchronously rather than spawning a goroutine per job) never runs up the live goroutine count
+// in proportion to the number of jobs offered.
+func TestNumbersFetchPoolBounded(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	maxWorkers := 10
+	g := &numbersGetterCounting{NumbersGetter: NumbersGetterStub{
+		Config: map[string]NumbersGetterStubCfg{
+			"/test1": stubConfig([]int{1, 2, 3, 4}, 10),
+		},
+	}}
+	pool := NewNumbersFetchPool(NumbersFetchPoolCfg{MaxWorkers: maxWorkers, QueueDepth: 1000})
+	loops := 500
+	c := make(chan urlResult, loops)
+	before := runtime.NumGoroutine()
+
+	// Sample goroutine count concurrently with submission, since the count after the burst has
+	// drained says nothing about the peak seen while it was in flight.
+	peakGoroutines := int32(before)
+	stop := make(chan struct{})
+	var samplerWg sync.WaitGroup
+	samplerWg.Add(1)
+	go func() {
+		defer samplerWg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n := int32(runtime.NumGoroutine()); n > atomic.LoadInt32(&peakGoroutines) {
+				atomic.StoreInt32(&peakGoroutines, n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for i := 0; i < loops; i++ {
+		if err := pool.submit(context.Background(), g, "/test1", c); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	samplerWg.Wait()
+
+	for i := 0; i < loops; i++ {
+		<-c
+	}
+	if peak := atomic.LoadInt32(&g.peak); peak > int32(maxWorkers) {
+		t.Errorf("saw %d concurrent fetches, pool (%d workers) should have kept it bounded", peak, maxWorkers)
+	}
+	// The only goroutines the pool itself should add while the burst is in flight are its
+	// MaxWorkers workers, plus a little slack for the test's own submitting/sampling goroutines.
+	if slack := int32(maxWorkers + 4); peakGoroutines > int32(before)+slack {
+		t.Errorf("peak goroutines grew from %d to %d while submitting %d jobs, want growth bounded by ~%d workers", before, peakGoroutines, loops, maxWorkers)
+	}
+}
+
+// countingListener wraps a net.Listener and counts accepted connections, so tests can assert
+// that a client reused a keep-alive connection instead of dialing a new one per request.
+type countingListener struct {
+	net.Listener
+	accepts int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepts, 1)
+	}
+	return conn, err
+}
+
+// Sequential calls to the same host through one NumbersGetterHttp should reuse a single
+// keep-alive connection rather than dialing a new one per request.
+func TestNumbersGetterHttpReusesConnections(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: ln}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"numbers": [1]}`))
+	})}
+	go server.Serve(cl)
+	defer server.Close()
+
+	g := NewNumbersGetterHttp(defaultNumbersGetterHttpCfg())
+	url := "http://" + ln.Addr().String() + "/test"
+	for i := 0; i < 5; i++ {
+		res, err := g.get(context.Background(), url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != http.StatusOK || !numbers_cmp(res.Numbers, []int{1}) {
+			t.Errorf("Got numbers %v, status %d", res.Numbers, res.Status)
+		}
+	}
+	if accepts := atomic.LoadInt32(&cl.accepts); accepts != 1 {
+		t.Errorf("got %d accepted connections, expected 1 (connection should be reused)", accepts)
+	}
+}
+
+// numbersGetterCountingCalls wraps a NumbersGetter and counts how many times `get` was actually
+// invoked, regardless of concurrency.
+type numbersGetterCountingCalls struct {
+	NumbersGetter
+	calls int32
+}
+
+func (g *numbersGetterCountingCalls) get(ctx context.Context, url string) (Result, error) {
+	atomic.AddInt32(&g.calls, 1)
+	return g.NumbersGetter.get(ctx, url)
+}
+
+// N concurrent callers asking for the same url should result in exactly one upstream call.
+func TestNumbersGetterCoalescingDedupes(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	inner := &numbersGetterCountingCalls{NumbersGetter: NumbersGetterStub{
+		Config: map[string]NumbersGetterStubCfg{
+			"/test1": stubConfig([]int{1, 2, 3}, 50),
+		},
+	}}
+	g := NewNumbersGetterCoalescing(inner)
+	n := 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := g.get(context.Background(), "/test1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if res.Status != 200 || !numbers_cmp(res.Numbers, []int{1, 2, 3}) {
+				t.Errorf("Got numbers %v, status %d", res.Numbers, res.Status)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := atomic.LoadInt32(&inner.calls); calls != 1 {
+		t.Errorf("got %d upstream calls, expected 1", calls)
+	}
+}
+
+// The leader call (the one that actually triggers the upstream fetch) must respect its own
+// context like every other caller, instead of blocking for the full duration of a slow wrapped
+// getter regardless of the leader's deadline.
+func TestNumbersGetterCoalescingLeaderRespectsContext(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	inner := NumbersGetterStub{
+		Config: map[string]NumbersGetterStubCfg{
+			"/test1": stubConfig([]int{1}, 300),
+		},
+	}
+	retry := NewNumbersGetterRetry(inner, NumbersGetterRetryCfg{MaxAttempts: 3, BaseDelay: 0})
+	g := NewNumbersGetterCoalescing(retry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := g.get(ctx, "/test1")
+	elapsed := time.Now().Sub(start)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got err %v, expected context.DeadlineExceeded", err)
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Errorf("leader call took %v, should have returned once its own 50ms context expired", elapsed)
+	}
+}
+
+// A gzip-encoded response body should be transparently decompressed.
+func TestNumbersGetterHttpGzip(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"numbers": [1, 2, 3]}`))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	g := NumbersGetterHttp{}
+	res, err := g.get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != http.StatusOK || !numbers_cmp(res.Numbers, []int{1, 2, 3}) {
+		t.Errorf("Got numbers %v, status %d", res.Numbers, res.Status)
+	}
+}
+
+// A response that gets cut off mid-array should fail instead of silently returning a partial result.
+func TestNumbersGetterHttpTruncatedStream(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("ResponseWriter doesn't support hijacking")
+		}
+		conn, buf, err := hj.Hijack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		body := `{"numbers": [1, 2,`
+		fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body)+100, body)
+		buf.Flush()
+	}))
+	defer server.Close()
+
+	g := NumbersGetterHttp{}
+	_, err := g.get(context.Background(), server.URL)
+	if err == nil {
+		t.Error("expected an error decoding a truncated stream, got nil")
+	}
+}
+
+// MaxResponseBytes should clip an oversized response instead of reading it all into memory.
+func TestNumbersGetterHttpMaxResponseBytes(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"numbers": [`))
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(w, "%d,", i)
+		}
+		w.Write([]byte(`0]}`))
+	}))
+	defer server.Close()
+
+	cfg := defaultNumbersGetterHttpCfg()
+	cfg.MaxResponseBytes = 8
+	g := NewNumbersGetterHttp(cfg)
+	_, err := g.get(context.Background(), server.URL)
+	if err == nil {
+		t.Error("expected an error past MaxResponseBytes, got nil")
+	}
+}
+
+// A slow dial should show up as Timings.Connect on the returned Result.
+func TestNumbersGetterHttpTimingsConnect(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"numbers": [1]}`))
+	}))
+	defer server.Close()
+
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				time.Sleep(20 * time.Millisecond)
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	g := NumbersGetterHttp{client: client}
+	res, err := g.get(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Timings.Connect <= 0 {
+		t.Errorf("expected Timings.Connect > 0, got %v", res.Timings.Connect)
+	}
+}
+
+// numbersGetterFlaky returns a 503 for its first `failures` calls, then 200 with Numbers.
+type numbersGetterFlaky struct {
+	failures int32
+	calls    int32
+	Numbers  []int
+}
+
+func (g *numbersGetterFlaky) get(ctx context.Context, url string) (Result, error) {
+	if atomic.AddInt32(&g.calls, 1) <= g.failures {
+		return Result{Status: http.StatusServiceUnavailable}, nil
+	}
+	return Result{Numbers: g.Numbers, Status: http.StatusOK}, nil
+}
+
+// Two transient 503s followed by a 200 should succeed once retries are exhausted against them.
+func TestNumbersGetterRetry(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	g := &numbersGetterFlaky{failures: 2, Numbers: []int{1, 2, 3}}
+	r := NewNumbersGetterRetry(g, NumbersGetterRetryCfg{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    10 * time.Millisecond,
+		Jitter:      true,
+	})
+	res, err := r.get(context.Background(), "/test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != http.StatusOK || !numbers_cmp(res.Numbers, []int{1, 2, 3}) {
+		t.Errorf("Got numbers %v, status %d", res.Numbers, res.Status)
+	}
+	if calls := atomic.LoadInt32(&g.calls); calls != 3 {
+		t.Errorf("got %d calls, expected 3 (2 failures + 1 success)", calls)
+	}
+}
+
+// A cancelled context should abort the retry loop instead of sleeping through the backoff.
+func TestNumbersGetterRetryRespectsContext(t *testing.T) {
+	log.SetFlags(0)
+	log.SetOutput(ioutil.Discard)
+	g := &numbersGetterFlaky{failures: 100}
+	r := NewNumbersGetterRetry(g, NumbersGetterRetryCfg{
+		MaxAttempts: 100,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Second,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, _ := r.get(ctx, "/test1")
+	if res.Status != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, expected the last observed 503", res.Status)
+	}
+	if calls := atomic.LoadInt32(&g.calls); calls != 1 {
+		t.Errorf("got %d calls, expected 1 (no retry once context is done)", calls)
+	}
+}
+
 // No mocks anymore. Real http endpoints for /numbers and /tests-s
 // This test fails in ~1% cases. Random connection to /numbers or /test gest refused.
 // TODO: Further investigation required.